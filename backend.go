@@ -0,0 +1,146 @@
+// Copyright 2016 Chao Wang <hit9@icloud.com>
+
+package diskstack
+
+import (
+	"fmt"
+	"os"
+)
+
+// Backend is the storage a Stack reads and writes its records to. The
+// default, used by Open, is an os.File; OpenWith accepts any Backend,
+// which lets tests run against an in-memory implementation without
+// touching disk, and leaves room for remote or encrypted backends to be
+// layered on top later.
+type Backend interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	Truncate(size int64) error
+	Sync() error
+	Size() (int64, error)
+	Close() error
+}
+
+// Compactor is implemented by Backends that support building a
+// rewritten copy out-of-line and swapping it in atomically, used by a
+// CompactBackground compaction to avoid blocking Put/Pop for the
+// duration of the rewrite.
+type Compactor interface {
+	// NewScratch returns a fresh, empty Backend to copy live bytes into.
+	NewScratch() (Backend, error)
+
+	// Swap atomically replaces this backend's contents with scratch's,
+	// then closes scratch. After Swap returns successfully, reads and
+	// writes against the receiver observe scratch's bytes.
+	Swap(scratch Backend) error
+
+	// DiscardScratch closes and removes a scratch Backend obtained from
+	// NewScratch that will never be passed to Swap, e.g. because the
+	// compaction building it failed partway through. It must not be
+	// called after a successful Swap.
+	DiscardScratch(scratch Backend) error
+}
+
+// fileBackend is the default Backend, backed by an os.File.
+type fileBackend struct {
+	file *os.File
+}
+
+func (b *fileBackend) ReadAt(p []byte, off int64) (int, error) {
+	return b.file.ReadAt(p, off)
+}
+
+func (b *fileBackend) WriteAt(p []byte, off int64) (int, error) {
+	return b.file.WriteAt(p, off)
+}
+
+func (b *fileBackend) Truncate(size int64) error {
+	return b.file.Truncate(size)
+}
+
+func (b *fileBackend) Sync() error {
+	return b.file.Sync()
+}
+
+func (b *fileBackend) Size() (int64, error) {
+	info, err := b.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (b *fileBackend) Close() error {
+	return b.file.Close()
+}
+
+// NewScratch creates a sibling ".compact" file to copy live bytes into.
+func (b *fileBackend) NewScratch() (Backend, error) {
+	tmp, err := os.OpenFile(b.file.Name()+".compact", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileBackend{file: tmp}, nil
+}
+
+// Swap closes both files and atomically renames scratch's sibling
+// ".compact" file over the receiver's, then reopens it under the
+// original name. If the rename itself fails, the receiver is reopened
+// under its original (unswapped) name instead, so a failed compaction
+// doesn't leave the backend unusable.
+func (b *fileBackend) Swap(scratch Backend) error {
+	sb, ok := scratch.(*fileBackend)
+	if !ok {
+		return fmt.Errorf("diskstack: Swap requires a scratch from the same backend's NewScratch")
+	}
+	name, tmpName := b.file.Name(), sb.file.Name()
+	if err := sb.file.Close(); err != nil {
+		return err
+	}
+	if err := b.file.Close(); err != nil {
+		// b.file is already closed even though the close call itself
+		// failed (close(2) always consumes the descriptor), so reopen
+		// it under its own name for the same reason as the rename
+		// failure below: leaving b.file pointing at a dead handle would
+		// break every later call on this backend.
+		f, reopenErr := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+		if reopenErr != nil {
+			return fmt.Errorf("diskstack: close failed (%v) and reopening the original file also failed: %w", err, reopenErr)
+		}
+		b.file = f
+		return err
+	}
+	if err := os.Rename(tmpName, name); err != nil {
+		// b.file is already closed; reopen the original, un-swapped file
+		// under its own name so the backend is still usable even though
+		// the compaction itself failed, rather than leaving the Stack
+		// stuck with a dead file handle. If the reopen itself also fails
+		// there's nothing left to fall back to, so surface that instead
+		// of the rename error, since it's the one that actually explains
+		// why every later call on this backend will fail too.
+		f, reopenErr := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+		if reopenErr != nil {
+			return fmt.Errorf("diskstack: rename failed (%v) and reopening the original file also failed: %w", err, reopenErr)
+		}
+		b.file = f
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	b.file = f
+	return nil
+}
+
+// DiscardScratch closes scratch's file and removes its sibling
+// ".compact" file from disk.
+func (b *fileBackend) DiscardScratch(scratch Backend) error {
+	sb, ok := scratch.(*fileBackend)
+	if !ok {
+		return fmt.Errorf("diskstack: DiscardScratch requires a scratch from the same backend's NewScratch")
+	}
+	name := sb.file.Name()
+	sb.file.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,17 @@
+// Copyright 2016 Chao Wang <hit9@icloud.com>
+
+package diskstack
+
+import "fmt"
+
+// ErrCorrupt is returned by Top and Pop when a record's stored CRC32
+// does not match its data, which usually means the file was left with a
+// torn write after a crash. Call Recover to discard the damaged tail.
+type ErrCorrupt struct {
+	// Offset is the file offset of the corrupt record's data.
+	Offset int64
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("diskstack: corrupt record at offset %d", e.Offset)
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Chao Wang <hit9@icloud.com>
+
+package diskstack
+
+import "io"
+
+// MemBackend is a Backend that keeps its data in memory, for tests and
+// other uses that don't need durability.
+type MemBackend struct {
+	buf []byte
+}
+
+// NewMemBackend returns an empty in-memory Backend.
+func NewMemBackend() *MemBackend {
+	return &MemBackend{}
+}
+
+func (b *MemBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(b.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *MemBackend) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > int64(len(b.buf)) {
+		grown := make([]byte, end)
+		copy(grown, b.buf)
+		b.buf = grown
+	}
+	copy(b.buf[off:end], p)
+	return len(p), nil
+}
+
+func (b *MemBackend) Truncate(size int64) error {
+	switch {
+	case size < int64(len(b.buf)):
+		b.buf = b.buf[:size]
+	case size > int64(len(b.buf)):
+		grown := make([]byte, size)
+		copy(grown, b.buf)
+		b.buf = grown
+	}
+	return nil
+}
+
+func (b *MemBackend) Sync() error {
+	return nil
+}
+
+func (b *MemBackend) Size() (int64, error) {
+	return int64(len(b.buf)), nil
+}
+
+func (b *MemBackend) Close() error {
+	return nil
+}
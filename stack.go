@@ -0,0 +1,892 @@
+// Copyright 2016 Chao Wang <hit9@icloud.com>
+
+// Package diskstack implements a simple disk-backed stack (LIFO), safe
+// for concurrent use.
+//
+// Each item is appended to the tail of the file together with a small
+// trailer recording its length and the file offset of the record below
+// it, which lets Top/Pop find and read the last item without scanning
+// the whole file. Popped space is only reclaimed once the accumulated
+// fragment bytes cross Options.FragmentsThreshold, see Compact.
+package diskstack
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// trailerLen is the number of bytes appended after every record's
+	// data: a 4-byte big-endian length, followed by an 8-byte big-endian
+	// offset pointing at the start of the record below it. Records may
+	// carry additional trailer bytes on top of this depending on which
+	// of the header flags below are set for the file.
+	trailerLen = 4 + 8
+
+	// compressionFlagLen is the extra trailer byte used to record
+	// whether a given record's data is Snappy-compressed, present when
+	// flagCompression is set in the header.
+	compressionFlagLen = 1
+
+	// checksumLen is the extra trailer bytes used to store a record's
+	// CRC32 (Castagnoli), present when flagChecksum is set in the
+	// header.
+	checksumLen = 4
+
+	// header is written to the file the first time it is created with
+	// Options.Checksum and/or Options.Compression enabled, so that
+	// reopening it later (regardless of what Options are passed then)
+	// can tell which extra trailer fields its records carry, and so
+	// stacks created before these features existed keep reading as the
+	// plain trailerLen format with no header at all.
+	headerMagic = "DSTK"
+	headerLen   = len(headerMagic) + 1
+
+	// flagChecksum and flagCompression are bits of the header's flags
+	// byte (the byte right after headerMagic).
+	flagChecksum    = 1 << 0
+	flagCompression = 1 << 1
+
+	// minCompressSize is the smallest record data size that gets
+	// Snappy-compressed; smaller values are stored raw since Snappy's
+	// framing overhead would outweigh any savings.
+	minCompressSize = 64
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Compression identifies a record payload compression scheme.
+type Compression int
+
+const (
+	// NoCompression stores record data as-is.
+	NoCompression Compression = iota
+	// SnappyCompression stores record data Snappy-encoded, skipping
+	// records smaller than minCompressSize.
+	SnappyCompression
+)
+
+// SyncPolicy controls when a Stack fsyncs the backend. The zero value
+// is SyncAlways.
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration
+}
+
+type syncMode int
+
+const (
+	syncAlways syncMode = iota
+	syncIntervalMode
+	syncNone
+)
+
+var (
+	// SyncAlways fsyncs after every write (Put, Pop's fragment
+	// reclamation, PopN, Compact, Recover). This is the default and
+	// matches the behavior of every Stack before SyncPolicy existed.
+	SyncAlways = SyncPolicy{mode: syncAlways}
+
+	// SyncNone never fsyncs automatically; call Stack.Sync to flush.
+	SyncNone = SyncPolicy{mode: syncNone}
+)
+
+// SyncInterval returns a SyncPolicy that fsyncs from a background
+// goroutine every d, instead of on every write. A non-positive d can't
+// drive a ticker, so it falls back to SyncAlways rather than silently
+// disabling both the periodic and the per-write fsync.
+func SyncInterval(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy{mode: syncIntervalMode, interval: d}
+}
+
+// CompactionMode controls how a Stack reclaims fragment bytes once
+// Options.FragmentsThreshold is crossed. The zero value is CompactSync.
+type CompactionMode int
+
+const (
+	// CompactSync reclaims fragments immediately and synchronously, on
+	// the goroutine that tripped the threshold (the original, and still
+	// simplest, behavior). For large stacks this can block Put/Pop for
+	// as long as the rewrite takes.
+	CompactSync CompactionMode = iota
+
+	// CompactBackground reclaims fragments on a separate goroutine, in
+	// chunks of Options.CompactChunkSize, so Put/Pop/Compact are blocked
+	// for at most one chunk's worth of I/O rather than for the whole
+	// rewrite.
+	CompactBackground
+
+	// CompactManual disables automatic compaction entirely; callers must
+	// call Compact themselves.
+	CompactManual
+)
+
+// defaultCompactChunkSize is used when Options.CompactChunkSize is <= 0.
+const defaultCompactChunkSize = 64 * 1024
+
+// Options controls how a Stack behaves. A nil Options is equivalent to
+// the zero value.
+type Options struct {
+	// FragmentsThreshold is the number of reclaimable fragment bytes
+	// (popped records still sitting on disk) that may accumulate before
+	// Compact is triggered automatically. Zero disables automatic
+	// compaction; callers may still call Compact themselves.
+	FragmentsThreshold int64
+
+	// Checksum enables per-record CRC32 (Castagnoli) checksums. It only
+	// has an effect when the stack file is created (i.e. it is empty at
+	// Open time); reopening an existing file always uses whatever format
+	// it was originally created with, regardless of this setting.
+	Checksum bool
+
+	// Compression enables transparent payload compression. Like
+	// Checksum, it only has an effect when the stack file is created;
+	// reopening an existing file always uses the format it was created
+	// with.
+	Compression Compression
+
+	// SyncPolicy controls when the stack fsyncs the backend. The zero
+	// value is SyncAlways.
+	SyncPolicy SyncPolicy
+
+	// CompactionMode controls how FragmentsThreshold-triggered reclaims
+	// are carried out. The zero value is CompactSync.
+	CompactionMode CompactionMode
+
+	// CompactChunkSize is the number of bytes copied per iteration by a
+	// CompactBackground compaction. Defaults to 64KiB when <= 0.
+	CompactChunkSize int64
+}
+
+// Stack is a disk-backed LIFO stack. It is safe for concurrent use by
+// multiple goroutines.
+type Stack struct {
+	backend Backend
+	opts    *Options
+	mu      sync.RWMutex
+
+	// offset is the logical end of the stack: the file offset at which
+	// the next Put will write, and the position Pop/Top read their
+	// trailer from.
+	offset int64
+
+	// size is the current physical size of the file: the high-water mark
+	// of offset, since Put reuses fragment space left by Pop instead of
+	// always appending. It only grows when offset passes it and only
+	// shrinks via Compact/Clear, so size >= offset and size-offset is the
+	// number of fragment bytes awaiting reclamation.
+	size int64
+
+	// base is the offset past the header, 0 for files with no header.
+	base int64
+
+	// checksum reports whether records in this file carry a trailing
+	// CRC32, as recorded by the header when the file was created.
+	checksum bool
+
+	// compression reports whether records in this file carry a
+	// compression flag byte and may be Snappy-encoded, as recorded by
+	// the header when the file was created.
+	compression bool
+
+	// count is the number of items currently on the stack, maintained
+	// incrementally so Len doesn't need to walk the stack.
+	count int64
+
+	// stopSync and syncDone coordinate shutting down the background
+	// goroutine started for SyncInterval policies; both are nil
+	// otherwise.
+	stopSync chan struct{}
+	syncDone chan struct{}
+
+	// compacting reports whether a CompactBackground reclaim is already
+	// in flight, so Pop doesn't spawn overlapping ones.
+	compacting bool
+
+	// compactWG lets Close wait for an in-flight CompactBackground
+	// goroutine to finish before closing the backend out from under it.
+	compactWG sync.WaitGroup
+
+	// closing is set by Close, under s.mu, before it waits on compactWG,
+	// so Pop stops spawning new CompactBackground goroutines at the same
+	// point Close stops accepting new ones to wait for; without this a
+	// Pop racing Close could call compactWG.Add(1) after Close's Wait
+	// had already returned on a zero counter.
+	closing bool
+
+	// compactErr holds the error from the most recent CompactBackground
+	// reclaim, or nil if none has failed. See CompactionError.
+	compactErr error
+
+	// compactLow is the lowest value offset has taken since
+	// backgroundCompact last trusted its scratch copy up to its `copied`
+	// pointer; only meaningful while compacting is true. Put reuses
+	// fragment space below offset, so a Pop/PopN/Clear that lowers
+	// offset below an already-copied point means scratch may now be
+	// stale there; backgroundCompact retreats `copied` to compactLow
+	// (via noteOffsetReduced) to force a re-copy instead of swapping in
+	// bytes that predate the reuse.
+	compactLow int64
+}
+
+// noteOffsetReduced records that s.offset has just been lowered, for a
+// CompactBackground reclaim that may be in flight to notice. s.mu must
+// be held.
+func (s *Stack) noteOffsetReduced() {
+	if s.compacting && s.offset < s.compactLow {
+		s.compactLow = s.offset
+	}
+}
+
+// Open opens the stack file at fileName, creating it if it does not
+// exist. A nil opts is equivalent to &Options{}.
+func Open(fileName string, opts *Options) (*Stack, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s, err := OpenWith(&fileBackend{file: file}, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenWith opens a Stack backed by an arbitrary Backend, e.g. a
+// MemBackend for tests. A nil opts is equivalent to &Options{}.
+func OpenWith(backend Backend, opts *Options) (*Stack, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	size, err := backend.Size()
+	if err != nil {
+		return nil, err
+	}
+	s := &Stack{
+		backend: backend,
+		opts:    opts,
+	}
+	if size == 0 {
+		var flags byte
+		if opts.Checksum {
+			flags |= flagChecksum
+		}
+		if opts.Compression != NoCompression {
+			flags |= flagCompression
+		}
+		if flags != 0 {
+			hdr := make([]byte, headerLen)
+			copy(hdr, headerMagic)
+			hdr[len(headerMagic)] = flags
+			if _, err := backend.WriteAt(hdr, 0); err != nil {
+				return nil, err
+			}
+			if err := backend.Sync(); err != nil {
+				return nil, err
+			}
+			s.base = int64(headerLen)
+			s.checksum = flags&flagChecksum != 0
+			s.compression = flags&flagCompression != 0
+		}
+	} else {
+		hdr := make([]byte, headerLen)
+		if n, _ := backend.ReadAt(hdr, 0); n == headerLen && string(hdr[:len(headerMagic)]) == headerMagic {
+			s.base = int64(headerLen)
+			flags := hdr[len(headerMagic)]
+			s.checksum = flags&flagChecksum != 0
+			s.compression = flags&flagCompression != 0
+		}
+	}
+	s.offset = size
+	if size == 0 {
+		s.offset = s.base
+	}
+	s.size = s.offset
+	_, _, tLen := s.trailerLayout()
+	s.count = s.countChain(s.offset, tLen)
+	if opts.SyncPolicy.mode == syncIntervalMode && opts.SyncPolicy.interval > 0 {
+		s.stopSync = make(chan struct{})
+		s.syncDone = make(chan struct{})
+		go s.syncLoop(opts.SyncPolicy.interval)
+	}
+	return s, nil
+}
+
+// syncLoop periodically fsyncs the backend for a SyncInterval policy,
+// until stopSync is closed.
+func (s *Stack) syncLoop(d time.Duration) {
+	defer close(s.syncDone)
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.backend.Sync()
+			s.mu.Unlock()
+		case <-s.stopSync:
+			return
+		}
+	}
+}
+
+// shouldSync reports whether a write should fsync immediately, per the
+// configured SyncPolicy. Must be called with s.mu held.
+func (s *Stack) shouldSync() bool {
+	return s.opts.SyncPolicy.mode == syncAlways
+}
+
+// trailerLayout returns the trailer byte offsets (relative to the start
+// of a record's trailer) for the optional compression flag and checksum
+// fields, and the trailer's total length. An offset of -1 means the
+// field is absent for this stack's file.
+func (s *Stack) trailerLayout() (compOff, crcOff, total int64) {
+	total = trailerLen
+	compOff = -1
+	crcOff = -1
+	if s.compression {
+		compOff = total
+		total += compressionFlagLen
+	}
+	if s.checksum {
+		crcOff = total
+		total += checksumLen
+	}
+	return compOff, crcOff, total
+}
+
+// recordTrailerLen returns the number of trailer bytes used by records
+// in this stack's file.
+func (s *Stack) recordTrailerLen() int64 {
+	_, _, total := s.trailerLayout()
+	return total
+}
+
+// Close closes the underlying file.
+func (s *Stack) Close() error {
+	if s.stopSync != nil {
+		close(s.stopSync)
+		<-s.syncDone
+	}
+	// Stop Pop from spawning any further CompactBackground goroutines
+	// before waiting on compactWG, so the Add(1) for any goroutine we
+	// need to wait for has already happened (both happen under s.mu) and
+	// no new one can start after we've decided to stop waiting.
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.compactWG.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backend.Close()
+}
+
+// Sync flushes any unsynced writes to the backend. It is a no-op for
+// SyncAlways, which is already fsynced after every write.
+func (s *Stack) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backend.Sync()
+}
+
+// Len returns the number of items currently on the stack.
+func (s *Stack) Len() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count
+}
+
+// Size returns the current on-disk size of the stack file in bytes.
+func (s *Stack) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// Put appends data to the top of the stack.
+func (s *Stack) Put(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := data
+	var compressed byte
+	if s.compression && len(data) >= minCompressSize {
+		stored = snappy.Encode(nil, data)
+		compressed = 1
+	}
+	length := uint32(len(stored))
+	compOff, crcOff, tLen := s.trailerLayout()
+	buf := make([]byte, int64(length)+tLen)
+	copy(buf, stored)
+	binary.BigEndian.PutUint32(buf[length:], length)
+	binary.BigEndian.PutUint64(buf[length+4:], uint64(s.offset))
+	if compOff >= 0 {
+		buf[int64(length)+compOff] = compressed
+	}
+	if crcOff >= 0 {
+		binary.BigEndian.PutUint32(buf[int64(length)+crcOff:], crc32.Checksum(stored, crcTable))
+	}
+	// Write at s.offset, not s.size: the trailer above encodes s.offset
+	// as this record's prevOffset, so the record's data must actually
+	// start there too, reusing whatever fragment bytes an unreclaimed
+	// Pop left behind instead of stranding them between offset and size.
+	if _, err := s.backend.WriteAt(buf, s.offset); err != nil {
+		return err
+	}
+	s.offset += int64(len(buf))
+	if s.offset > s.size {
+		s.size = s.offset
+	}
+	s.count++
+	if s.shouldSync() {
+		if err := s.backend.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRecordAt reads the record whose trailer ends at the file offset
+// end, returning its data and the offset of the record below it (s.base
+// if this is the bottom-most record). It does not mutate the stack. It
+// returns ErrCorrupt if the stack was opened with checksums and the
+// record's stored data does not match its CRC32.
+func (s *Stack) readRecordAt(end int64) (data []byte, prevOffset int64, err error) {
+	if end == s.base {
+		return nil, 0, nil
+	}
+	compOff, crcOff, tLen := s.trailerLayout()
+	trailer := make([]byte, tLen)
+	if _, err := s.backend.ReadAt(trailer, end-tLen); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(trailer[:4])
+	prevOffset = int64(binary.BigEndian.Uint64(trailer[4:12]))
+	dataEnd := end - tLen
+	if prevOffset < s.base || prevOffset > dataEnd || dataEnd-prevOffset != int64(length) {
+		// A corrupt or torn trailer can point anywhere, including at or
+		// past itself; without this check callers that loop on
+		// prevOffset (Iterate, countChain) would spin forever instead
+		// of surfacing ErrCorrupt.
+		return nil, 0, &ErrCorrupt{Offset: dataEnd}
+	}
+	stored := make([]byte, length)
+	if _, err := s.backend.ReadAt(stored, prevOffset); err != nil {
+		return nil, 0, err
+	}
+	if crcOff >= 0 {
+		want := binary.BigEndian.Uint32(trailer[crcOff:])
+		if crc32.Checksum(stored, crcTable) != want {
+			return nil, 0, &ErrCorrupt{Offset: prevOffset}
+		}
+	}
+	if compOff >= 0 && trailer[compOff] != 0 {
+		data, err = snappy.Decode(nil, stored)
+		if err != nil {
+			return nil, 0, &ErrCorrupt{Offset: prevOffset}
+		}
+		return data, prevOffset, nil
+	}
+	return stored, prevOffset, nil
+}
+
+// readTop reads the record currently on top of the stack without
+// mutating the stack, returning its data and the offset of the record
+// below it (s.base if this is the bottom-most record).
+func (s *Stack) readTop() (data []byte, prevOffset int64, err error) {
+	return s.readRecordAt(s.offset)
+}
+
+// Iterate walks the stack from top to bottom, calling fn with each
+// item's index (0 at the top) and data. It does not mutate the stack.
+// Iteration stops and Iterate returns fn's error as soon as fn returns
+// a non-nil error.
+func (s *Stack) Iterate(fn func(index int, data []byte) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	end := s.offset
+	for index := 0; end != s.base; index++ {
+		data, prevOffset, err := s.readRecordAt(end)
+		if err != nil {
+			return err
+		}
+		if err := fn(index, data); err != nil {
+			return err
+		}
+		end = prevOffset
+	}
+	return nil
+}
+
+// PopN pops up to n items off the top of the stack in one go, returned
+// top-first (the same order repeated Pop calls would yield). Unlike
+// Pop, which leaves popped records on disk as reclaimable fragments,
+// PopN reclaims their space immediately with a single Truncate and a
+// single Sync, rather than one pair per item.
+func (s *Stack) PopN(n int) ([][]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([][]byte, 0, n)
+	end := s.offset
+	for len(items) < n && end != s.base {
+		data, prevOffset, err := s.readRecordAt(end)
+		if err != nil {
+			return items, err
+		}
+		items = append(items, data)
+		end = prevOffset
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	if err := s.backend.Truncate(end); err != nil {
+		return items, err
+	}
+	s.size = end
+	s.offset = end
+	s.noteOffsetReduced()
+	s.count -= int64(len(items))
+	if s.shouldSync() {
+		if err := s.backend.Sync(); err != nil {
+			return items, err
+		}
+	}
+	return items, nil
+}
+
+// Top returns the item on top of the stack without popping it. It
+// returns nil, nil if the stack is empty.
+func (s *Stack) Top() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, _, err := s.readTop()
+	return data, err
+}
+
+// Pop removes and returns the item on top of the stack. It returns nil,
+// nil if the stack is empty.
+func (s *Stack) Pop() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, prevOffset, err := s.readTop()
+	if err != nil || data == nil {
+		return data, err
+	}
+	s.offset = prevOffset
+	s.noteOffsetReduced()
+	s.count--
+	if s.opts.FragmentsThreshold > 0 && s.size-s.offset >= s.opts.FragmentsThreshold {
+		switch s.opts.CompactionMode {
+		case CompactManual:
+			// Automatic compaction disabled; caller must call Compact.
+		case CompactBackground:
+			if !s.compacting && !s.closing {
+				s.compacting = true
+				s.compactWG.Add(1)
+				go s.backgroundCompact()
+			}
+		default: // CompactSync
+			if err := s.compactLocked(); err != nil {
+				return data, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// Compact reclaims fragment bytes left behind by Pop by rewriting the
+// live portion of the backend ([0, offset)) back over itself and
+// shrinking it down to the logical offset. It always runs synchronously
+// on the calling goroutine, regardless of Options.CompactionMode; it is
+// the method CompactManual callers use to reclaim fragments themselves.
+// It shares s.mu with backgroundCompact's chunk loop, so the two can
+// never run against the backend at the same time.
+func (s *Stack) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// CompactionError returns the error from the most recent CompactBackground
+// reclaim, or nil if none has failed. A failed background compaction
+// leaves existing fragments unreclaimed but otherwise doesn't affect the
+// stack; callers that care should check this after Pop and fall back to
+// Compact if it's non-nil.
+func (s *Stack) CompactionError() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.compactErr
+}
+
+// backgroundCompact reclaims fragment bytes without holding s.mu for the
+// whole rewrite: it copies the live region into a scratch Backend
+// CompactChunkSize bytes at a time, taking s.mu for just that slice and
+// releasing it in between so Put/Pop/Compact are blocked for at most one
+// chunk's worth of I/O rather than the whole file. s.backend's identity
+// never changes after Open (Swap mutates the Compactor in place), so the
+// type assertion and NewScratch run without the lock, same as before.
+//
+// Re-reading s.offset at the top of every iteration (instead of fixing a
+// target up front) means a Put or Pop growing it is simply picked up by
+// a later iteration. But Put also reuses fragment space *below* offset
+// (see Put), so a Pop/PopN/Clear that lowers offset beneath a point
+// already copied into scratch means a later Put can overwrite bytes
+// scratch has already cached and considers done; compactLow (maintained
+// by noteOffsetReduced) records the lowest offset seen since, so this
+// loop can retreat `copied` and recopy that range instead of swapping in
+// stale data. Every read and write of the backend happens with s.mu
+// held, so none of this ever races Compact or another Put/Pop.
+//
+// It is a no-op if the backend doesn't support out-of-line compaction
+// (see Compactor), falling back to the blocking compactLocked. Any
+// failure is recorded on s.compactErr (see CompactionError) rather than
+// silently dropped, and the scratch file is discarded rather than left
+// behind on disk.
+func (s *Stack) backgroundCompact() {
+	defer func() {
+		s.mu.Lock()
+		s.compacting = false
+		s.mu.Unlock()
+		s.compactWG.Done()
+	}()
+
+	compactor, ok := s.backend.(Compactor)
+	if !ok {
+		s.mu.Lock()
+		s.compactErr = s.compactLocked()
+		s.mu.Unlock()
+		return
+	}
+	chunkSize := s.opts.CompactChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultCompactChunkSize
+	}
+	scratch, err := compactor.NewScratch()
+	if err != nil {
+		s.mu.Lock()
+		s.compactErr = err
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	s.compactLow = s.offset
+	s.mu.Unlock()
+
+	buf := make([]byte, chunkSize)
+	var copied int64
+	for {
+		s.mu.Lock()
+		liveEnd := s.offset
+		if s.compactLow < copied {
+			copied = s.compactLow
+		}
+		s.compactLow = liveEnd
+		if copied >= liveEnd {
+			s.compactErr = s.finishBackgroundCompact(compactor, scratch, liveEnd)
+			s.mu.Unlock()
+			return
+		}
+		n := chunkSize
+		if remaining := liveEnd - copied; remaining < n {
+			n = remaining
+		}
+		if _, err := s.backend.ReadAt(buf[:n], copied); err != nil {
+			compactor.DiscardScratch(scratch)
+			s.compactErr = err
+			s.mu.Unlock()
+			return
+		}
+		if _, err := scratch.WriteAt(buf[:n], copied); err != nil {
+			compactor.DiscardScratch(scratch)
+			s.compactErr = err
+			s.mu.Unlock()
+			return
+		}
+		copied += n
+		s.mu.Unlock()
+	}
+}
+
+// finishBackgroundCompact truncates scratch to liveEnd, syncs it, and
+// swaps it in. s.mu must be held. scratch is discarded on any failure,
+// including Swap's own: Swap leaves the original backend reopened and
+// usable again when the rename itself fails, so it's always safe to
+// discard scratch here rather than leak its file.
+func (s *Stack) finishBackgroundCompact(compactor Compactor, scratch Backend, liveEnd int64) error {
+	if err := scratch.Truncate(liveEnd); err != nil {
+		compactor.DiscardScratch(scratch)
+		return err
+	}
+	if err := scratch.Sync(); err != nil {
+		compactor.DiscardScratch(scratch)
+		return err
+	}
+	if err := compactor.Swap(scratch); err != nil {
+		compactor.DiscardScratch(scratch)
+		return err
+	}
+	s.size = liveEnd
+	return nil
+}
+
+// compactLocked is Compact's implementation; s.mu must already be held.
+// It copies the live region in CompactChunkSize slices, like
+// backgroundCompact, rather than one s.offset-sized allocation, so a
+// large stack doesn't need to allocate its whole live size to compact.
+func (s *Stack) compactLocked() error {
+	if s.size == s.offset {
+		return nil
+	}
+	chunkSize := s.opts.CompactChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultCompactChunkSize
+	}
+	buf := make([]byte, chunkSize)
+	for pos := int64(0); pos < s.offset; {
+		n := chunkSize
+		if remaining := s.offset - pos; remaining < n {
+			n = remaining
+		}
+		if _, err := s.backend.ReadAt(buf[:n], pos); err != nil {
+			return err
+		}
+		if _, err := s.backend.WriteAt(buf[:n], pos); err != nil {
+			return err
+		}
+		pos += n
+	}
+	if err := s.backend.Truncate(s.offset); err != nil {
+		return err
+	}
+	if s.shouldSync() {
+		if err := s.backend.Sync(); err != nil {
+			return err
+		}
+	}
+	s.size = s.offset
+	return nil
+}
+
+// Clear empties the stack, discarding all items.
+func (s *Stack) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.backend.Truncate(s.base); err != nil {
+		return err
+	}
+	s.size = s.base
+	s.offset = s.base
+	s.noteOffsetReduced()
+	s.count = 0
+	return nil
+}
+
+// Recover repairs a stack file left behind by a crash mid-write. It
+// scans backwards from the tail looking for the last offset at which
+// every record, all the way down to the bottom of the stack, parses
+// cleanly and (if checksums are enabled) verifies against its CRC32.
+// Everything after that offset is considered a torn write and is
+// truncated away. Recover is a no-op if the file already verifies
+// cleanly.
+func (s *Stack) Recover() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _, tLen := s.trailerLayout()
+	for end := s.size; end >= s.base; end-- {
+		if !s.verifyChain(end, tLen) {
+			continue
+		}
+		if end == s.size {
+			return nil
+		}
+		if err := s.backend.Truncate(end); err != nil {
+			return err
+		}
+		s.size = end
+		s.offset = end
+		s.noteOffsetReduced()
+		s.count = s.countChain(end, tLen)
+		return s.backend.Sync()
+	}
+	// Nothing at all verified; the whole file is unusable.
+	if err := s.backend.Truncate(s.base); err != nil {
+		return err
+	}
+	s.size = s.base
+	s.offset = s.base
+	s.noteOffsetReduced()
+	s.count = 0
+	return s.backend.Sync()
+}
+
+// countChain counts the records in the chain ending at end, back down
+// to s.base, stopping at the first trailer whose prevOffset doesn't
+// move strictly closer to s.base. Such a trailer is corrupt (it would
+// otherwise make the walk loop forever or run off the file), so it is
+// simply treated as the bottom of the chain; callers that need to know
+// whether the chain is actually intact should use verifyChain instead.
+func (s *Stack) countChain(end, tLen int64) int64 {
+	var n int64
+	for end > s.base {
+		if end-s.base < tLen {
+			return n
+		}
+		trailer := make([]byte, tLen)
+		if _, err := s.backend.ReadAt(trailer, end-tLen); err != nil {
+			return n
+		}
+		length := int64(binary.BigEndian.Uint32(trailer[:4]))
+		prevOffset := int64(binary.BigEndian.Uint64(trailer[4:12]))
+		dataEnd := end - tLen
+		if prevOffset < s.base || prevOffset > dataEnd || dataEnd-prevOffset != length {
+			return n
+		}
+		n++
+		end = prevOffset
+	}
+	return n
+}
+
+// verifyChain reports whether every record in [s.base, end) forms a
+// complete chain of valid records back down to s.base.
+func (s *Stack) verifyChain(end, tLen int64) bool {
+	_, crcOff, _ := s.trailerLayout()
+	for end > s.base {
+		if end-s.base < tLen {
+			return false
+		}
+		trailer := make([]byte, tLen)
+		if _, err := s.backend.ReadAt(trailer, end-tLen); err != nil {
+			return false
+		}
+		length := int64(binary.BigEndian.Uint32(trailer[:4]))
+		prevOffset := int64(binary.BigEndian.Uint64(trailer[4:12]))
+		dataEnd := end - tLen
+		if prevOffset < s.base || prevOffset > dataEnd || dataEnd-prevOffset != length {
+			return false
+		}
+		if crcOff >= 0 {
+			data := make([]byte, length)
+			if _, err := s.backend.ReadAt(data, prevOffset); err != nil {
+				return false
+			}
+			if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(trailer[crcOff:]) {
+				return false
+			}
+		}
+		end = prevOffset
+	}
+	return end == s.base
+}
@@ -4,9 +4,12 @@ package diskstack
 
 import (
 	"bytes"
+	"encoding/binary"
 	"os"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Must asserts the given value is True for testing.
@@ -168,6 +171,384 @@ func TestClear(t *testing.T) {
 	Must(t, v == nil)
 }
 
+func TestChecksum(t *testing.T) {
+	fileName := "stack.db"
+	s, err := Open(fileName, &Options{Checksum: true})
+	Must(t, err == nil)
+	defer os.Remove(fileName)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	// Must verify and pop fine when nothing is corrupt.
+	data, err := s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data1) == 0)
+	// Reopening must still recognize the checksummed format.
+	s.Close()
+	s, _ = Open(fileName, &Options{Checksum: true})
+	Must(t, s.checksum)
+	Must(t, s.base == int64(headerLen))
+}
+
+func TestChecksumCorrupt(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, &Options{Checksum: true})
+	defer os.Remove(fileName)
+	Must(t, s.Put([]byte{1, 2, 3, 4}) == nil)
+	// Flip a data byte to break the stored checksum.
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	Must(t, err == nil)
+	_, err = f.WriteAt([]byte{0xff}, s.base)
+	Must(t, err == nil)
+	f.Close()
+	// Top/Pop must report the corruption rather than returning bad data.
+	_, err = s.Top()
+	_, ok := err.(*ErrCorrupt)
+	Must(t, ok)
+	// Recover should discard the corrupt tail, leaving an empty stack.
+	Must(t, s.Recover() == nil)
+	v, err := s.Pop()
+	Must(t, err == nil && v == nil)
+	info, _ := os.Stat(fileName)
+	Must(t, info.Size() == int64(headerLen))
+}
+
+func TestCorruptTrailerDoesNotHang(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, nil)
+	defer os.Remove(fileName)
+	Must(t, s.Put([]byte{1, 2, 3, 4}) == nil)
+	Must(t, s.Put([]byte{5, 6, 7, 8}) == nil)
+	end := s.offset
+	Must(t, s.Close() == nil)
+	// Corrupt the last trailer's prevOffset to point at itself instead
+	// of an earlier offset. CRC32 only covers record payloads, not
+	// trailer fields, so this kind of corruption is invisible to the
+	// checksum feature; Open must still return promptly rather than
+	// looping forever walking the chain.
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	Must(t, err == nil)
+	bogus := make([]byte, 8)
+	binary.BigEndian.PutUint64(bogus, uint64(end))
+	_, err = f.WriteAt(bogus, end-8)
+	Must(t, err == nil)
+	Must(t, f.Close() == nil)
+	done := make(chan *Stack, 1)
+	go func() {
+		s2, _ := Open(fileName, nil)
+		done <- s2
+	}()
+	select {
+	case s2 := <-done:
+		Must(t, s2 != nil)
+		defer s2.Close()
+		_, err := s2.Top()
+		_, ok := err.(*ErrCorrupt)
+		Must(t, ok)
+		// Recover should discard the corrupt tail rather than hang too.
+		Must(t, s2.Recover() == nil)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Open hung on a corrupt trailer")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	fileName := "stack.db"
+	s, err := Open(fileName, &Options{Compression: SnappyCompression})
+	Must(t, err == nil)
+	defer os.Remove(fileName)
+	small := []byte{1, 2, 3, 4}
+	var large []byte
+	for i := 0; i < 256; i++ {
+		large = append(large, 'a')
+	}
+	// Must put/pop both below and above the compression threshold ok.
+	Must(t, s.Put(small) == nil)
+	Must(t, s.Put(large) == nil)
+	data, err := s.Pop()
+	Must(t, err == nil && bytes.Compare(data, large) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, small) == 0)
+	// The compressible item must actually have been stored smaller than
+	// it was put in.
+	Must(t, s.Put(large) == nil)
+	info, _ := os.Stat(fileName)
+	Must(t, info.Size() < int64(headerLen)+int64(len(large)))
+}
+
+func TestIterate(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, nil)
+	defer os.Remove(fileName)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	data3 := []byte{9, 10, 11, 12}
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	Must(t, s.Put(data3) == nil)
+	var got [][]byte
+	err := s.Iterate(func(index int, data []byte) error {
+		Must(t, index == len(got))
+		got = append(got, data)
+		return nil
+	})
+	Must(t, err == nil && len(got) == 3)
+	Must(t, bytes.Compare(got[0], data3) == 0)
+	Must(t, bytes.Compare(got[1], data2) == 0)
+	Must(t, bytes.Compare(got[2], data1) == 0)
+	// Iterate must not mutate the stack.
+	data, err := s.Top()
+	Must(t, err == nil && bytes.Compare(data, data3) == 0)
+}
+
+func TestPopN(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, nil)
+	defer os.Remove(fileName)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	data3 := []byte{9, 10, 11, 12}
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	Must(t, s.Put(data3) == nil)
+	// Must pop the top 2 items, top-first, in one go.
+	items, err := s.PopN(2)
+	Must(t, err == nil && len(items) == 2)
+	Must(t, bytes.Compare(items[0], data3) == 0)
+	Must(t, bytes.Compare(items[1], data2) == 0)
+	// Must have reclaimed the popped bytes immediately.
+	info, _ := os.Stat(fileName)
+	Must(t, info.Size() == int64(len(data1))+4+8)
+	// Asking for more than is left must only return what's there.
+	items, err = s.PopN(5)
+	Must(t, err == nil && len(items) == 1)
+	Must(t, bytes.Compare(items[0], data1) == 0)
+	items, err = s.PopN(1)
+	Must(t, err == nil && items == nil)
+}
+
+func TestPutAfterPartialPop(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, nil)
+	defer os.Remove(fileName)
+	dataA := []byte{1, 2, 3, 4}
+	dataB := []byte{5, 6, 7, 8}
+	dataC := []byte{9, 10, 11, 12}
+	dataD := []byte{13, 14, 15, 16}
+	Must(t, s.Put(dataA) == nil)
+	Must(t, s.Put(dataB) == nil)
+	Must(t, s.Put(dataC) == nil)
+	// Pop only the top item, leaving a reclaimable fragment behind it
+	// (every other test happens to pop all the way to empty first, which
+	// is why this case was never exercised).
+	v, err := s.Pop()
+	Must(t, err == nil && bytes.Compare(v, dataC) == 0)
+	Must(t, s.Put(dataD) == nil)
+	var got [][]byte
+	err = s.Iterate(func(index int, data []byte) error {
+		got = append(got, data)
+		return nil
+	})
+	Must(t, err == nil && len(got) == 3)
+	Must(t, bytes.Compare(got[0], dataD) == 0)
+	Must(t, bytes.Compare(got[1], dataB) == 0)
+	Must(t, bytes.Compare(got[2], dataA) == 0)
+}
+
+func TestOpenWithMemBackend(t *testing.T) {
+	s, err := OpenWith(NewMemBackend(), nil)
+	Must(t, err == nil)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	data, err := s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data1) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && data == nil)
+}
+
+func TestLenAndSize(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, nil)
+	defer os.Remove(fileName)
+	Must(t, s.Len() == 0 && s.Size() == 0)
+	data := []byte{1, 2, 3, 4}
+	s.Put(data)
+	s.Put(data)
+	Must(t, s.Len() == 2)
+	info, _ := os.Stat(fileName)
+	Must(t, s.Size() == info.Size())
+	s.Pop()
+	Must(t, s.Len() == 1)
+	s.Clear()
+	Must(t, s.Len() == 0 && s.Size() == 0)
+}
+
+func TestConcurrentPutPop(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, nil)
+	defer os.Remove(fileName)
+	data := []byte("12345678")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.Put(data)
+			}
+		}()
+	}
+	wg.Wait()
+	Must(t, s.Len() == 400)
+	for i := 0; i < 400; i++ {
+		v, err := s.Pop()
+		Must(t, err == nil && bytes.Compare(v, data) == 0)
+	}
+	Must(t, s.Len() == 0)
+}
+
+func TestSyncPolicyNone(t *testing.T) {
+	fileName := "stack.db"
+	s, err := Open(fileName, &Options{SyncPolicy: SyncNone})
+	Must(t, err == nil)
+	defer os.Remove(fileName)
+	Must(t, s.Put([]byte{1, 2, 3, 4}) == nil)
+	// Put must still be readable even without an automatic fsync.
+	data, err := s.Top()
+	Must(t, err == nil && bytes.Compare(data, []byte{1, 2, 3, 4}) == 0)
+	Must(t, s.Sync() == nil)
+}
+
+func TestSyncPolicyInterval(t *testing.T) {
+	fileName := "stack.db"
+	interval := 10 * time.Millisecond
+	s, err := Open(fileName, &Options{SyncPolicy: SyncInterval(interval)})
+	Must(t, err == nil)
+	defer os.Remove(fileName)
+	Must(t, s.Put([]byte{1, 2, 3, 4}) == nil)
+	// Wait past the interval so the background goroutine has synced at
+	// least once, then confirm Close doesn't hang waiting on it.
+	time.Sleep(5 * interval)
+	data, err := s.Top()
+	Must(t, err == nil && bytes.Compare(data, []byte{1, 2, 3, 4}) == 0)
+	Must(t, s.Close() == nil)
+}
+
+func TestSyncIntervalNonPositiveFallsBackToSyncAlways(t *testing.T) {
+	Must(t, SyncInterval(0) == SyncAlways)
+	Must(t, SyncInterval(-time.Second) == SyncAlways)
+}
+
+func TestCompactionModeManual(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, &Options{FragmentsThreshold: 1, CompactionMode: CompactManual})
+	defer os.Remove(fileName)
+	data := []byte("12345678")
+	s.Put(data)
+	s.Put(data)
+	s.Pop()
+	sizeBeforeCompact := s.Size()
+	// FragmentsThreshold is crossed, but CompactManual must not reclaim
+	// automatically.
+	Must(t, s.Size() == sizeBeforeCompact)
+	Must(t, s.Compact() == nil)
+	Must(t, s.Size() == s.Len()*int64(len(data)+trailerLen))
+}
+
+func TestCompactionModeBackground(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, &Options{FragmentsThreshold: 1, CompactionMode: CompactBackground, CompactChunkSize: 4})
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".compact")
+	data := []byte("12345678")
+	for i := 0; i < 10; i++ {
+		Must(t, s.Put(data) == nil)
+	}
+	for i := 0; i < 9; i++ {
+		_, err := s.Pop()
+		Must(t, err == nil)
+	}
+	// The background reclaim races with the test; poll for it to finish
+	// rather than assuming it has by the time Pop returns.
+	recordLen := int64(len(data) + trailerLen)
+	for i := 0; i < 100 && s.Size() != recordLen; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	Must(t, s.Size() == recordLen)
+	v, err := s.Top()
+	Must(t, err == nil && bytes.Compare(v, data) == 0)
+}
+
+func TestCompactionModeBackgroundClose(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, &Options{FragmentsThreshold: 1, CompactionMode: CompactBackground, CompactChunkSize: 4})
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".compact")
+	data := []byte("12345678")
+	for i := 0; i < 10; i++ {
+		Must(t, s.Put(data) == nil)
+	}
+	_, err := s.Pop()
+	Must(t, err == nil)
+	// Close right after triggering a background compaction: it must
+	// wait for that goroutine rather than closing the file out from
+	// under its copy/swap.
+	Must(t, s.Close() == nil)
+}
+
+// TestCompactionModeBackgroundConcurrentPutPop interleaves Puts and Pops
+// with an ever-retriggering CompactBackground reclaim (a tiny
+// CompactChunkSize makes each reclaim take several lock-release/acquire
+// iterations, giving Put/Pop a real chance to land mid-copy) and checks
+// the chain is still intact afterward. Earlier Pop/Put tests only ever
+// run sequentially before the next reclaim starts, which wouldn't catch
+// a reclaim swapping in stale bytes for fragment space Put reused while
+// the copy was in flight.
+func TestCompactionModeBackgroundConcurrentPutPop(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, &Options{FragmentsThreshold: 1, CompactionMode: CompactBackground, CompactChunkSize: 4})
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".compact")
+	data := []byte("12345678")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				Must(t, s.Put(data) == nil)
+				if j%2 == 0 {
+					v, err := s.Pop()
+					Must(t, err == nil && (v == nil || bytes.Compare(v, data) == 0))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	wantLen := s.Len()
+	// Close waits for any still in-flight background compaction before
+	// closing the backend, so the file is guaranteed settled afterward.
+	Must(t, s.Close() == nil)
+	Must(t, s.CompactionError() == nil)
+	s2, err := Open(fileName, nil)
+	Must(t, err == nil)
+	defer s2.Close()
+	Must(t, s2.Len() == wantLen)
+	var got int
+	err = s2.Iterate(func(index int, v []byte) error {
+		Must(t, bytes.Compare(v, data) == 0)
+		got++
+		return nil
+	})
+	Must(t, err == nil && int64(got) == wantLen)
+}
+
 func BenchmarkPut(b *testing.B) {
 	fileName := "stack.db"
 	s, _ := Open(fileName, nil)